@@ -0,0 +1,33 @@
+package media
+
+import (
+	"image"
+	"io"
+
+	"github.com/Kagami/go-avif"
+)
+
+func init() {
+	RegisterCodec("image/avif", decodeAVIF, encodeAVIF)
+}
+
+func decodeAVIF(r io.Reader) (image.Image, error) {
+	return avif.Decode(r)
+}
+
+func encodeAVIF(w io.Writer, img image.Image, quality int) error {
+	return avif.Encode(w, img, &avif.Options{Quality: avifQuality(quality)})
+}
+
+// avifQuality maps the Encoder contract's 0-100 (higher is better) onto
+// go-avif's inverted 0-63 quantizer range (lower is better), clamping
+// input outside 0-100 first.
+func avifQuality(quality int) int {
+	switch {
+	case quality < 0:
+		quality = 0
+	case quality > 100:
+		quality = 100
+	}
+	return 63 - (quality*63+50)/100
+}
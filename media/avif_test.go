@@ -0,0 +1,27 @@
+package media
+
+import "testing"
+
+// TestAvifQuality checks that the Encoder contract's 0-100 (higher is
+// better) is mapped onto go-avif's inverted 0-63 quantizer range (lower
+// is better), and that out-of-range input is clamped.
+func TestAvifQuality(t *testing.T) {
+	cases := []struct {
+		quality int
+		want    int
+	}{
+		{quality: 100, want: 0},
+		{quality: 0, want: 63},
+		{quality: -10, want: 63},
+		{quality: 110, want: 0},
+	}
+	for _, c := range cases {
+		got := avifQuality(c.quality)
+		if got != c.want {
+			t.Errorf("avifQuality(%d) = %d, want %d", c.quality, got, c.want)
+		}
+	}
+	if got := avifQuality(50); got <= 0 || got >= 63 {
+		t.Errorf("avifQuality(50) = %d, want a mid-range value strictly between 0 and 63", got)
+	}
+}
@@ -0,0 +1,37 @@
+package media
+
+import (
+	"image"
+	"testing"
+)
+
+// TestBestForPicksSmallestAcceptable checks that BestFor returns the
+// smallest version whose ContentType the Accept header allows, rather
+// than e.g. always matching the first acceptable version in Versions.
+func TestBestForPicksSmallestAcceptable(t *testing.T) {
+	img := &Image{}
+	rect := image.Rect(0, 0, 10, 10)
+	orig := newImageVersion("test.png", "image/png", rect, 10, 10, false)
+	orig.ByteSize.SetInt(9000)
+	webp := newImageVersion("test.png", "image/webp", rect, 10, 10, false)
+	webp.ByteSize.SetInt(3000)
+	avif := newImageVersion("test.png", "image/avif", rect, 10, 10, false)
+	avif.ByteSize.SetInt(2000)
+	img.Versions = []ImageVersion{orig, webp, avif}
+	img.Init()
+
+	best := img.BestFor("image/webp,image/png;q=0.8")
+	if best == nil || best.ContentType.Get() != "image/webp" {
+		t.Fatalf("expected image/webp (avif not in Accept), got %+v", best)
+	}
+
+	best = img.BestFor("image/avif,image/webp,image/png")
+	if best == nil || best.ContentType.Get() != "image/avif" {
+		t.Fatalf("expected image/avif (smallest accepted format), got %+v", best)
+	}
+
+	best = img.BestFor("")
+	if best == nil || best.ContentType.Get() != "image/png" {
+		t.Fatalf("expected image/png fallback for empty Accept, got %+v", best)
+	}
+}
@@ -0,0 +1,44 @@
+package media
+
+import (
+	"image"
+	"io"
+)
+
+// Decoder decodes encoded image bytes into pixel data.
+type Decoder func(r io.Reader) (image.Image, error)
+
+// Encoder encodes pixel data into bytes at the given quality (0-100,
+// ignored by lossless formats).
+type Encoder func(w io.Writer, img image.Image, quality int) error
+
+type codec struct {
+	Decode Decoder
+	Encode Encoder
+}
+
+var codecs = map[string]codec{}
+
+// RegisterCodec registers a Decoder and/or Encoder for the given mime
+// type, e.g. "image/webp". Either may be nil if only one direction is
+// supported. JPEG and PNG are always handled by the standard library
+// and don't need to be registered.
+func RegisterCodec(mime string, dec Decoder, enc Encoder) {
+	codecs[mime] = codec{dec, enc}
+}
+
+func decoderFor(mime string) (Decoder, bool) {
+	c, ok := codecs[mime]
+	if !ok || c.Decode == nil {
+		return nil, false
+	}
+	return c.Decode, true
+}
+
+func encoderFor(mime string) (Encoder, bool) {
+	c, ok := codecs[mime]
+	if !ok || c.Encode == nil {
+		return nil, false
+	}
+	return c.Encode, true
+}
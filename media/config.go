@@ -0,0 +1,60 @@
+package media
+
+import (
+	"image/png"
+
+	"github.com/disintegration/imaging"
+)
+
+// Backend persists Images and the raw bytes of their ImageVersions.
+type Backend interface {
+	SaveImage(image *Image) error
+	SaveImageVersionData(version *ImageVersion, data []byte) error
+	LoadImageVersionData(version *ImageVersion) ([]byte, error)
+}
+
+// Config holds the package wide settings for image persistence and
+// resampling. Backend must be set by the application before any Image
+// is created or versioned.
+var Config = struct {
+	Backend Backend
+
+	// ResampleFilter is used whenever an ImageVersion is resized.
+	// Lanczos gives the best quality, Box the best speed.
+	ResampleFilter imaging.ResampleFilter
+
+	// JPEGQuality is used when re-encoding ImageVersions as JPEG.
+	JPEGQuality int
+
+	// PNGCompressionLevel is used when re-encoding ImageVersions as PNG.
+	PNGCompressionLevel png.CompressionLevel
+
+	// FormatQuality overrides the encode quality for a mime type handled
+	// by a codec registered via RegisterCodec, e.g. "image/webp" or
+	// "image/avif", so each format can be tuned independently of JPEGQuality
+	// and of each other. A format with no entry here falls back to JPEGQuality.
+	FormatQuality map[string]int
+
+	// OriginalCacheMaxBytes bounds the in-memory LRU of recently decoded
+	// Image originals (see Image.loadOriginalImage), so that a burst of
+	// differently sized derivations of the same Image amortizes the
+	// decode. Zero means DefaultOriginalCacheMaxBytes.
+	OriginalCacheMaxBytes int
+}{
+	ResampleFilter:      imaging.Lanczos,
+	JPEGQuality:         90,
+	PNGCompressionLevel: png.DefaultCompression,
+	FormatQuality: map[string]int{
+		"image/webp": 80,
+		"image/avif": 50,
+	},
+}
+
+// qualityFor returns the encode quality to use for contentType: its entry
+// in Config.FormatQuality if one is set, otherwise Config.JPEGQuality.
+func qualityFor(contentType string) int {
+	if q, ok := Config.FormatQuality[contentType]; ok {
+		return q
+	}
+	return Config.JPEGQuality
+}
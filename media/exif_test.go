@@ -0,0 +1,60 @@
+package media
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// asymmetricTestImage returns a 4x2 image where each pixel is a distinct
+// gray level, so a geometric transform can be checked by tracking where a
+// known pixel ends up rather than comparing whole images.
+func asymmetricTestImage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(y*4 + x)})
+		}
+	}
+	return img
+}
+
+// TestApplyExifOrientation checks that orientation 3 (rotate 180, the
+// common "upside-down" case for a camera held inverted) moves the pixel
+// at the top-left corner to the bottom-right, matching what a viewer
+// applying the EXIF tag itself would show.
+func TestApplyExifOrientation(t *testing.T) {
+	img := asymmetricTestImage()
+	topLeft := img.GrayAt(0, 0)
+
+	rotated := applyExifOrientation(img, 3)
+	b := rotated.Bounds()
+	bottomRight := rotated.At(b.Max.X-1, b.Max.Y-1)
+
+	r, _, _, _ := bottomRight.RGBA()
+	wantR, _, _, _ := topLeft.RGBA()
+	if r != wantR {
+		t.Errorf("orientation 3: top-left pixel (gray %v) not found at bottom-right after rotation, got %v", topLeft, bottomRight)
+	}
+}
+
+// TestApplyExifOrientationNoOp checks that orientation 1 (already
+// upright) is a no-op, since NewImage skips the transform for it but
+// applyExifOrientation should still behave correctly if called directly.
+func TestApplyExifOrientationNoOp(t *testing.T) {
+	img := asymmetricTestImage()
+	result := applyExifOrientation(img, 1)
+	if result.Bounds() != img.Bounds() {
+		t.Fatalf("orientation 1 changed bounds: got %v, want %v", result.Bounds(), img.Bounds())
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			want := img.GrayAt(x, y)
+			r, _, _, _ := result.At(x, y).RGBA()
+			wantR, _, _, _ := want.RGBA()
+			if r != wantR {
+				t.Errorf("orientation 1 at (%d,%d): got %v, want %v", x, y, r, wantR)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package media
+
+import (
+	"image"
+	"strings"
+)
+
+// ImageFilter transforms a decoded image, e.g. for color grading or
+// compositing effects. An ordered chain of filters can be applied via
+// Image.FilteredVersion. Filters are plain interface implementations,
+// so downstream packages can add custom ones without registering them
+// anywhere; see the media/filter package for the built-in set.
+type ImageFilter interface {
+	// Apply returns img with the filter's effect applied.
+	Apply(img image.Image) image.Image
+
+	// Fingerprint returns a stable string encoding the filter's type and
+	// parameters, used to build an ImageVersion's match key so that
+	// identical chains reuse a cached version and distinct chains don't.
+	Fingerprint() string
+}
+
+// filterChainFingerprint returns a stable fingerprint for an ordered
+// chain of filters, used as part of an ImageVersion's match key.
+func filterChainFingerprint(filters []ImageFilter) string {
+	if len(filters) == 0 {
+		return ""
+	}
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		parts[i] = f.Fingerprint()
+	}
+	return strings.Join(parts, "|")
+}
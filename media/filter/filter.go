@@ -0,0 +1,162 @@
+// Package filter provides the built-in media.ImageFilter implementations
+// usable with Image.FilteredVersion: Grayscale, Saturate, GaussianBlur,
+// Brightness, Contrast, Sharpen, Invert, Sepia and Overlay.
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+	"github.com/ungerik/go-start/media"
+)
+
+type grayscale struct{}
+
+// Grayscale converts the image to grayscale.
+var Grayscale media.ImageFilter = grayscale{}
+
+func (grayscale) Apply(img image.Image) image.Image { return imaging.Grayscale(img) }
+func (grayscale) Fingerprint() string                { return "grayscale" }
+
+type invert struct{}
+
+// Invert inverts the image's colors.
+var Invert media.ImageFilter = invert{}
+
+func (invert) Apply(img image.Image) image.Image { return imaging.Invert(img) }
+func (invert) Fingerprint() string                { return "invert" }
+
+type saturate struct{ percentage float64 }
+
+// Saturate adjusts color saturation by percentage, -100 to 100.
+func Saturate(percentage float64) media.ImageFilter {
+	return saturate{percentage}
+}
+
+func (f saturate) Apply(img image.Image) image.Image {
+	return imaging.AdjustSaturation(img, f.percentage)
+}
+func (f saturate) Fingerprint() string { return fmt.Sprintf("saturate(%g)", f.percentage) }
+
+type brightness struct{ percentage float64 }
+
+// Brightness adjusts brightness by percentage, -100 to 100.
+func Brightness(percentage float64) media.ImageFilter {
+	return brightness{percentage}
+}
+
+func (f brightness) Apply(img image.Image) image.Image {
+	return imaging.AdjustBrightness(img, f.percentage)
+}
+func (f brightness) Fingerprint() string { return fmt.Sprintf("brightness(%g)", f.percentage) }
+
+type contrast struct{ percentage float64 }
+
+// Contrast adjusts contrast by percentage, -100 to 100.
+func Contrast(percentage float64) media.ImageFilter {
+	return contrast{percentage}
+}
+
+func (f contrast) Apply(img image.Image) image.Image {
+	return imaging.AdjustContrast(img, f.percentage)
+}
+func (f contrast) Fingerprint() string { return fmt.Sprintf("contrast(%g)", f.percentage) }
+
+type sharpen struct{ sigma float64 }
+
+// Sharpen sharpens the image using a gaussian-blur based unsharp mask
+// with the given sigma.
+func Sharpen(sigma float64) media.ImageFilter {
+	return sharpen{sigma}
+}
+
+func (f sharpen) Apply(img image.Image) image.Image { return imaging.Sharpen(img, f.sigma) }
+func (f sharpen) Fingerprint() string                { return fmt.Sprintf("sharpen(%g)", f.sigma) }
+
+type gaussianBlur struct{ sigma float64 }
+
+// GaussianBlur blurs the image with the given sigma.
+func GaussianBlur(sigma float64) media.ImageFilter {
+	return gaussianBlur{sigma}
+}
+
+func (f gaussianBlur) Apply(img image.Image) image.Image { return imaging.Blur(img, f.sigma) }
+func (f gaussianBlur) Fingerprint() string                { return fmt.Sprintf("gaussianBlur(%g)", f.sigma) }
+
+type sepia struct{}
+
+// Sepia applies a classic sepia color tone.
+var Sepia media.ImageFilter = sepia{}
+
+func (sepia) Apply(img image.Image) image.Image {
+	gray := imaging.Grayscale(img)
+	return imaging.AdjustFunc(gray, func(c color.NRGBA) color.NRGBA {
+		r := float64(c.R)
+		return color.NRGBA{
+			R: clampByte(r * 1.07),
+			G: clampByte(r * 0.74),
+			B: clampByte(r * 0.43),
+			A: c.A,
+		}
+	})
+}
+
+func (sepia) Fingerprint() string { return "sepia" }
+
+func clampByte(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+type overlay struct {
+	img  image.Image
+	x, y int
+}
+
+// Overlay composites img onto the filtered image at (x, y).
+func Overlay(img image.Image, x, y int) media.ImageFilter {
+	return overlay{img, x, y}
+}
+
+func (f overlay) Apply(img image.Image) image.Image {
+	return imaging.Overlay(img, f.img, image.Pt(f.x, f.y), 1)
+}
+
+func (f overlay) Fingerprint() string {
+	return fmt.Sprintf("overlay(%s,%d,%d)", hashImage(f.img), f.x, f.y)
+}
+
+// hashImage returns a hex FNV-1a hash of img's bounds and pixel data, used
+// to derive stable filter fingerprints from overlay image content. A
+// pointer address would not work here: once the original image.Image is
+// freed, a later unrelated image can be allocated at the same address and
+// collide in Image.matchVersion, causing a filtered version to be served
+// with the wrong overlay silently composited in.
+func hashImage(img image.Image) string {
+	h := fnv.New64a()
+	b := img.Bounds()
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[0:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(b.Dy()))
+	h.Write(buf[:])
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			binary.BigEndian.PutUint16(buf[0:2], uint16(r))
+			binary.BigEndian.PutUint16(buf[2:4], uint16(g))
+			binary.BigEndian.PutUint16(buf[4:6], uint16(bl))
+			binary.BigEndian.PutUint16(buf[6:8], uint16(a))
+			h.Write(buf[:])
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
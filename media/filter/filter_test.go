@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"image"
+	"testing"
+)
+
+// TestFingerprintStability checks that a filter's Fingerprint is stable
+// across calls and deterministic by parameter value, since it is used as
+// part of an ImageVersion's match key: an unstable or colliding
+// fingerprint would either miss cache hits it should get, or serve one
+// filter chain's cached version for a different chain's request.
+func TestFingerprintStability(t *testing.T) {
+	if Grayscale.Fingerprint() != Grayscale.Fingerprint() {
+		t.Errorf("Grayscale.Fingerprint() is not stable across calls")
+	}
+	if Saturate(20).Fingerprint() != Saturate(20).Fingerprint() {
+		t.Errorf("Saturate(20).Fingerprint() is not stable across calls")
+	}
+	if Saturate(20).Fingerprint() == Saturate(40).Fingerprint() {
+		t.Errorf("Saturate(20) and Saturate(40) produced the same fingerprint")
+	}
+	if Saturate(20).Fingerprint() == Brightness(20).Fingerprint() {
+		t.Errorf("Saturate(20) and Brightness(20) produced the same fingerprint")
+	}
+}
+
+// TestOverlayFingerprintDependsOnContent checks that Overlay's fingerprint
+// is derived from the overlay image's pixel content rather than its
+// pointer identity, so two distinct *image.Image values with the same
+// content and position collapse to the same cached version, and two with
+// different content at the same position don't collide.
+func TestOverlayFingerprintDependsOnContent(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	a.Pix[0] = 10
+	b := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	b.Pix[0] = 10
+	c := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	c.Pix[0] = 200
+
+	if Overlay(a, 1, 2).Fingerprint() != Overlay(b, 1, 2).Fingerprint() {
+		t.Errorf("two distinct images with identical content produced different Overlay fingerprints")
+	}
+	if Overlay(a, 1, 2).Fingerprint() == Overlay(c, 1, 2).Fingerprint() {
+		t.Errorf("images with different content produced the same Overlay fingerprint")
+	}
+}
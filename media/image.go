@@ -2,14 +2,20 @@ package media
 
 import (
 	"bytes"
+	"fmt"
+	"hash/fnv"
 	"image"
 	"image/png"
 	_ "image/gif"
 	_ "code.google.com/p/go.image/tiff"
 	_ "code.google.com/p/go.image/bmp"
-	"image/draw"
 	"image/color"
+	"strings"
+	"sync"
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
 	"github.com/ungerik/go-start/model"
+	"golang.org/x/sync/singleflight"
 	// "github.com/ungerik/go-start/view"
 )
 
@@ -31,11 +37,14 @@ const (
 
 // NewImage creates a new Image and saves the original version to Config.Backend.
 // GIF, TIFF, BMP images will be read, but written as PNG.
+// JPEG images carrying an EXIF orientation tag are rotated/flipped so that
+// the stored original, and every version derived from it, is upright.
 func NewImage(filename string, data []byte) (*Image, error) {
 	i, t, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
+	reencode := false
 	if t == "gif" || t == "bmp" || t == "tiff" {
 		var buf bytes.Buffer
 		err = png.Encode(&buf, i)
@@ -49,6 +58,17 @@ func NewImage(filename string, data []byte) (*Image, error) {
 			return nil, err
 		}
 	}
+	grayscale := i.ColorModel() == color.GrayModel || i.ColorModel() == color.Gray16Model
+	if t == "jpeg" {
+		if x, exifErr := exif.Decode(bytes.NewReader(data)); exifErr == nil {
+			if tag, tagErr := x.Get(exif.Orientation); tagErr == nil {
+				if orientation, intErr := tag.Int(0); intErr == nil && orientation != 1 {
+					i = applyExifOrientation(i, orientation)
+					reencode = true
+				}
+			}
+		}
+	}
 	width := i.Bounds().Dx()
 	height := i.Bounds().Dy()
 	version := newImageVersion(
@@ -57,9 +77,15 @@ func NewImage(filename string, data []byte) (*Image, error) {
 		image.Rect(0, 0, width, height),
 		width,
 		height,
-		i.ColorModel() == color.GrayModel || i.ColorModel() == color.Gray16Model,
+		grayscale,
 	)
-	err = version.SaveImageData(data)
+	version.computePlaceholderMetadata(i)
+	if reencode {
+		err = version.SaveImage(i)
+	} else {
+		version.ByteSize.SetInt(len(data))
+		err = version.SaveImageData(data)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -68,11 +94,51 @@ func NewImage(filename string, data []byte) (*Image, error) {
 	return image, nil
 }
 
+// applyExifOrientation returns img transformed according to the EXIF
+// orientation tag (1-8) so that its pixel data appears upright without
+// requiring a viewer to interpret the tag itself.
+func applyExifOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
 type Image struct {
 	ID          model.String `bson:",omitempty"`
 	Description model.String
 	Link        model.Url
 	Versions    []ImageVersion
+
+	// FocalPoint, when set, overrides the center bias used by
+	// SmartVersion so the smart crop window is pulled towards it instead.
+	FocalPoint model.Point `bson:",omitempty"`
+
+	// smartCropCache holds the lazily computed energy map used by
+	// SmartVersion, keyed to this Image's original version.
+	smartCropCache *smartCropEnergyMap
+
+	// mu guards Versions against concurrent appends from sourceRectVersion.
+	mu sync.RWMutex
+
+	// versionGroup deduplicates concurrent sourceRectVersion calls that
+	// request the exact same version, so only one of them decodes the
+	// original and writes to Config.Backend.
+	versionGroup singleflight.Group
 }
 
 func (self *Image) Init() {
@@ -105,6 +171,12 @@ func (self *Image) Grayscale() bool {
 	return self.Versions[0].Grayscale.Get()
 }
 
+// DominantColors returns up to 5 dominant colors of the original image,
+// see ImageVersion.DominantColors.
+func (self *Image) DominantColors() []color.Color {
+	return self.Versions[0].DominantColors()
+}
+
 // AspectRatio returns Width / Height
 func (self *Image) AspectRatio() float64 {
 	return self.Versions[0].AspectRatio()
@@ -175,55 +247,230 @@ func (self *Image) touchOriginalFromInsideSourceRect(width, height int, horAlign
 // SourceRectVersion searches and returns an existing matching version,
 // or a new one will be created and saved.
 func (self *Image) SourceRectVersion(sourceRect image.Rectangle, width, height int, grayscale bool, outsideColor color.Color) (im *ImageVersion, err error) {
+	return self.sourceRectVersion(sourceRect, width, height, grayscale, outsideColor, nil, "")
+}
+
+// sourceRectVersion is the shared implementation behind SourceRectVersion,
+// FilteredVersion and VersionWithFormat. filters, if given, are applied
+// in order after cropping/resizing. format, if given, overrides the
+// version's ContentType instead of inheriting the original's. Both are
+// folded into the version's match key so identical requests reuse a
+// cached version and distinct ones don't.
+//
+// Lookup and creation are safe for concurrent use: a singleflight group
+// keyed on the full match key ensures that concurrent requests for the
+// same version decode the original and write to Config.Backend only
+// once, with every caller receiving the same *ImageVersion.
+func (self *Image) sourceRectVersion(sourceRect image.Rectangle, width, height int, grayscale bool, outsideColor color.Color, filters []ImageFilter, format string) (im *ImageVersion, err error) {
 	if self.Grayscale() {
 		grayscale = true // Ignore color requests when original image is grayscale
 	}
+	filterKey := filterChainFingerprint(filters)
+	contentType := format
+	if contentType == "" {
+		contentType = self.ContentType()
+	}
+
+	if v := self.matchVersion(sourceRect, width, height, grayscale, outsideColor, filterKey, contentType); v != nil {
+		return v, nil
+	}
+
+	key := fmt.Sprintf("%v|%d|%d|%v|%v|%s|%s", sourceRect, width, height, grayscale, outsideColor, filterKey, contentType)
+	result, err, _ := self.versionGroup.Do(key, func() (interface{}, error) {
+		// Another caller may have produced and saved this exact version
+		// while we were waiting to join the singleflight group.
+		if v := self.matchVersion(sourceRect, width, height, grayscale, outsideColor, filterKey, contentType); v != nil {
+			return v, nil
+		}
+
+		origImage, err := self.loadOriginalImage()
+		if err != nil {
+			return nil, err
+		}
 
-	// Search for exact match
+		var versionImage image.Image
+		if sourceRect.In(self.Rectangle()) {
+			versionImage = imaging.Resize(imaging.Crop(origImage, sourceRect), width, height, Config.ResampleFilter)
+		} else {
+			canvas := imaging.New(width, height, outsideColor)
+			visible := sourceRect.Intersect(self.Rectangle())
+			if !visible.Empty() {
+				// Resize the visible intersection by the same factor the full
+				// sourceRect would be scaled by, then paste it onto the
+				// outsideColor canvas at the matching offset.
+				scaleX := float64(width) / float64(sourceRect.Dx())
+				scaleY := float64(height) / float64(sourceRect.Dy())
+				scaledWidth := int(float64(visible.Dx())*scaleX + 0.5)
+				scaledHeight := int(float64(visible.Dy())*scaleY + 0.5)
+				scaled := imaging.Resize(imaging.Crop(origImage, visible), scaledWidth, scaledHeight, Config.ResampleFilter)
+				offsetX := int(float64(visible.Min.X-sourceRect.Min.X) * scaleX)
+				offsetY := int(float64(visible.Min.Y-sourceRect.Min.Y) * scaleY)
+				canvas = imaging.Paste(canvas, scaled, image.Pt(offsetX, offsetY))
+			}
+			versionImage = canvas
+		}
+
+		if grayscale {
+			versionImage = imaging.Grayscale(versionImage)
+		}
+
+		for _, f := range filters {
+			versionImage = f.Apply(versionImage)
+		}
+
+		// Encoding and BlurHash/dominant-color extraction are both O(pixels)
+		// and touch only versionImage, so run them before taking self.mu:
+		// holding the lock for their duration would serialize unrelated
+		// version lookups on this Image, and writing their results into a
+		// pointer obtained before the lock is released is unsafe anyway —
+		// a concurrent append for a different version can reallocate
+		// self.Versions' backing array out from under a stale pointer.
+		data, err := encodeImage(contentType, versionImage)
+		if err != nil {
+			return nil, err
+		}
+		dominantColorHexes, blurHash := computePlaceholderStrings(versionImage)
+
+		self.mu.Lock()
+		self.Versions = append(self.Versions, newImageVersion(self.Filename(), contentType, sourceRect, width, height, grayscale))
+		version := &self.Versions[len(self.Versions)-1]
+		version.OutsideColor.SetColor(outsideColor)
+		version.Filters.Set(filterKey)
+		version.ByteSize.SetInt(len(data))
+		version.DominantColorHexes.Set(dominantColorHexes)
+		version.BlurHashValue.Set(blurHash)
+		self.mu.Unlock()
+
+		// From here on version is only read, or handed to code that persists
+		// it by reference without mutating its fields, so the pointer taken
+		// above stays safe to use even if another append reallocates the
+		// slice afterwards.
+		if err := version.SaveImageData(data); err != nil {
+			return nil, err
+		}
+		// Config.Backend.SaveImage reads self.Versions, which a concurrent
+		// singleflight call for a different key can append to (and
+		// reallocate) at the same time, so take the same RWMutex a reader
+		// would.
+		self.mu.RLock()
+		err = Config.Backend.SaveImage(self)
+		self.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		return version, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*ImageVersion), nil
+}
+
+// matchVersion returns an already generated version matching the given
+// parameters, or nil if there is none.
+func (self *Image) matchVersion(sourceRect image.Rectangle, width, height int, grayscale bool, outsideColor color.Color, filterKey, contentType string) *ImageVersion {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	for i := range self.Versions {
 		v := &self.Versions[i]
 		match := v.SourceRect.Rectangle() == sourceRect &&
 			v.Width.GetInt() == width &&
 			v.Height.GetInt() == height &&
 			v.OutsideColor.EqualsColor(outsideColor) &&
-			v.Grayscale.Get() == grayscale
+			v.Grayscale.Get() == grayscale &&
+			v.Filters.Get() == filterKey &&
+			v.ContentType.Get() == contentType
 		if match {
-			return v, nil
+			return v
 		}
 	}
+	return nil
+}
 
-	// No exact match, create version
-	origImage, err := self.Versions[0].LoadImage()
+// loadOriginalImage decodes this Image's original, reusing a recently
+// decoded copy from the package-wide LRU cache when available so a
+// burst of differently sized derivations amortizes the decode.
+func (self *Image) loadOriginalImage() (image.Image, error) {
+	key, err := self.originalCacheKey()
 	if err != nil {
 		return nil, err
 	}
-
-	var versionImage image.Image
-	if sourceRect.In(self.Rectangle()) {
-		versionImage = ResizeImage(origImage, sourceRect, width, height)
-	} else {
-		if grayscale {
-			versionImage = image.NewGray(image.Rect(0, 0, width, height))
-		} else {
-			versionImage = image.NewRGBA(image.Rect(0, 0, width, height))
-		}
-		// Fill version with outsideColor
-		draw.Draw(versionImage.(draw.Image), versionImage.Bounds(), image.NewUniform(outsideColor), image.ZP, draw.Src)
-
-		// todo scale and draw sub image
-
+	if img, ok := decodedOriginals.get(key); ok {
+		return img, nil
 	}
-	self.Versions = append(self.Versions, newImageVersion(self.Filename(), self.ContentType(), sourceRect, width, height, grayscale))
-	version := &self.Versions[len(self.Versions)-1]
-	err = version.SaveImage(versionImage)
+	img, err := self.Versions[0].LoadImage()
 	if err != nil {
 		return nil, err
 	}
-	err = Config.Backend.SaveImage(self)
+	b := img.Bounds()
+	decodedOriginals.put(key, img, b.Dx()*b.Dy()*4)
+	return img, nil
+}
+
+// originalCacheKey returns a stable identity for this Image's original to
+// key the decodedOriginals cache by. A pointer address is not usable here:
+// once an *Image is freed, the allocator can reuse its address for a later,
+// unrelated Image, which would then silently receive the wrong cached pixels.
+// Image.ID is preferred when set, but it is assigned by the database layer
+// on insert and so is empty for the common case of generating thumbnails
+// right after NewImage and before the Image has been persisted; filename
+// and dimensions alone are not unique enough for that case (e.g. two
+// uploads sharing a generic filename and camera resolution), so the
+// fallback hashes the original's actual raw bytes instead.
+func (self *Image) originalCacheKey() (string, error) {
+	if id := self.ID.Get(); id != "" {
+		return id, nil
+	}
+	data, err := self.Versions[0].LoadImageData()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return version, nil
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// FilteredVersion returns a version of width x height with the ordered
+// filter chain applied after cropping/resizing, persisting the result as
+// a new ImageVersion. The filter chain is part of the version's match
+// key, so requesting the same chain again reuses the cached version.
+func (self *Image) FilteredVersion(width, height int, horAlign HorAlignment, verAlign VerAlignment, filters ...ImageFilter) (im *ImageVersion, err error) {
+	return self.sourceRectVersion(self.touchOriginalFromInsideSourceRect(width, height, horAlign, verAlign), width, height, self.Grayscale(), color.RGBA{}, filters, "")
+}
+
+// VersionWithFormat is like Version but re-encodes the result as format
+// (a mime type such as "image/webp" or "image/avif", see RegisterCodec)
+// instead of inheriting the original's ContentType, so a single original
+// can yield derivatives in several formats side-by-side.
+func (self *Image) VersionWithFormat(width, height int, horAlign HorAlignment, verAlign VerAlignment, grayscale bool, format string) (im *ImageVersion, err error) {
+	return self.sourceRectVersion(self.touchOriginalFromInsideSourceRect(width, height, horAlign, verAlign), width, height, grayscale, color.RGBA{}, nil, format)
+}
+
+// BestFor returns the smallest already generated ImageVersion whose
+// ContentType is listed in the HTTP Accept header value accept, or
+// nil if none match. It lets callers serve the lightest derivative a
+// browser supports without re-deriving anything. A ContentType counts as
+// listed if accept contains it literally or contains "*/*"; type wildcards
+// such as "image/*" and q-values are not interpreted, and an empty accept
+// matches only JPEG and PNG.
+func (self *Image) BestFor(accept string) (best *ImageVersion) {
+	for i := range self.Versions {
+		v := &self.Versions[i]
+		if !acceptsContentType(accept, v.ContentType.Get()) {
+			continue
+		}
+		if best == nil || v.ByteSize.GetInt() < best.ByteSize.GetInt() {
+			best = v
+		}
+	}
+	return best
+}
+
+func acceptsContentType(accept, contentType string) bool {
+	if accept == "" {
+		return contentType == "image/jpeg" || contentType == "image/png"
+	}
+	return strings.Contains(accept, contentType) || strings.Contains(accept, "*/*")
 }
 
 func (self *Image) VersionTouchOrigFromOutside(width, height int, horAlign HorAlignment, verAlign VerAlignment, grayscale bool, outsideColor color.Color) (im *ImageVersion, err error) {
@@ -241,3 +488,66 @@ func (self *Image) CenteredVersion(width, height int, grayscale bool) (im *Image
 func (self *Image) CenteredVersionTouchOrigFromOutside(width, height int, grayscale bool, outsideColor color.Color) (im *ImageVersion, err error) {
 	return self.VersionTouchOrigFromOutside(width, height, HorCenter, VerCenter, grayscale, outsideColor)
 }
+
+// SmartVersion returns a version of width x height whose source rectangle
+// is chosen automatically based on image content instead of a fixed
+// alignment: the window of the requested aspect ratio with the highest
+// edge energy is picked, with a mild bias towards FocalPoint if it has
+// been set, or the image center otherwise.
+func (self *Image) SmartVersion(width, height int, grayscale bool) (im *ImageVersion, err error) {
+	return self.smartVersion(width, height, grayscale, self.focalPointOrCenter())
+}
+
+// CenteredSmartVersion is like SmartVersion but always biases the window
+// search towards the image center, ignoring any FocalPoint override.
+func (self *Image) CenteredSmartVersion(width, height int, grayscale bool) (im *ImageVersion, err error) {
+	return self.smartVersion(width, height, grayscale, self.centerPoint())
+}
+
+func (self *Image) smartVersion(width, height int, grayscale bool, bias image.Point) (im *ImageVersion, err error) {
+	em, err := self.energyMap()
+	if err != nil {
+		return nil, err
+	}
+	sourceRect := em.bestWindow(float64(width)/float64(height), bias)
+	return self.SourceRectVersion(sourceRect, width, height, grayscale, color.RGBA{})
+}
+
+func (self *Image) centerPoint() image.Point {
+	return image.Pt(self.Width()/2, self.Height()/2)
+}
+
+func (self *Image) focalPointOrCenter() image.Point {
+	if !self.FocalPoint.IsZero() {
+		return self.FocalPoint.GetPoint()
+	}
+	return self.centerPoint()
+}
+
+// energyMap returns the cached edge-energy map of this Image's original,
+// computing and caching it on first use so repeated smart crops of the
+// same Image reuse the analysis. Guarded by mu like Versions, since
+// concurrent SmartVersion/CenteredSmartVersion calls on the same Image
+// would otherwise race on smartCropCache.
+func (self *Image) energyMap() (*smartCropEnergyMap, error) {
+	self.mu.RLock()
+	cached := self.smartCropCache
+	self.mu.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	orig, err := self.Versions[0].LoadImage()
+	if err != nil {
+		return nil, err
+	}
+	em := newSmartCropEnergyMap(orig)
+
+	self.mu.Lock()
+	if self.smartCropCache == nil {
+		self.smartCropCache = em
+	}
+	cached = self.smartCropCache
+	self.mu.Unlock()
+	return cached, nil
+}
@@ -0,0 +1,257 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+)
+
+// memoryBackend is a minimal in-memory Backend used to exercise
+// Image/ImageVersion without any real storage.
+type memoryBackend struct {
+	mu        sync.Mutex
+	data      map[string][]byte
+	saves     int
+	lastCount int
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{data: make(map[string][]byte)}
+}
+
+// versionKey identifies version by its persisted fields rather than its
+// address: Image.Versions holds ImageVersion values, so NewImage saves the
+// original through a copy and later appends can move versions in memory.
+func versionKey(version *ImageVersion) string {
+	v := *version
+	v.image = nil
+	return fmt.Sprintf("%#v", v)
+}
+
+// SaveImage reads image.Versions, like a real backend serializing the
+// version list would, so a caller that forgets to hold image.mu while
+// calling this shows up as a data race under -race.
+func (self *memoryBackend) SaveImage(image *Image) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.saves++
+	self.lastCount = len(image.Versions)
+	return nil
+}
+
+func (self *memoryBackend) SaveImageVersionData(version *ImageVersion, data []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	self.data[versionKey(version)] = cp
+	return nil
+}
+
+func (self *memoryBackend) LoadImageVersionData(version *ImageVersion) ([]byte, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.data[versionKey(version)], nil
+}
+
+func testPNG(width, height int) []byte {
+	return testPNGWithSeed(width, height, 128)
+}
+
+// testPNGWithSeed is like testPNG but lets the caller vary pixel content
+// via seed, so two otherwise identical (same size) test images can be
+// told apart by decoding them back.
+func testPNGWithSeed(width, height int, seed uint8) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x % 256), uint8(y % 256), seed, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// TestSourceRectVersionConcurrent stresses sourceRectVersion with many
+// goroutines requesting the exact same version simultaneously: they must
+// all receive the same *ImageVersion and only one version may be appended.
+func TestSourceRectVersionConcurrent(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	img, err := NewImage("test.png", testPNG(400, 300))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	const goroutines = 20
+	results := make([]*ImageVersion, goroutines)
+	errs := make([]error, goroutines)
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = img.CenteredVersion(100, 100, false)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("goroutine %d: %v", i, err)
+		}
+	}
+
+	first := results[0]
+	for i, v := range results {
+		if v != first {
+			t.Errorf("goroutine %d got a different *ImageVersion than goroutine 0; singleflight dedup failed", i)
+		}
+	}
+
+	if len(img.Versions) != 2 {
+		t.Errorf("expected 2 versions (original + one derived), got %d", len(img.Versions))
+	}
+}
+
+// TestSourceRectVersionConcurrentDistinctSizes ensures that concurrent
+// requests for genuinely different versions of the same Image don't race
+// on the shared Versions slice or Config.Backend.
+func TestSourceRectVersionConcurrentDistinctSizes(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	img, err := NewImage("test.png", testPNG(400, 300))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	sizes := []int{50, 75, 100, 125, 150}
+	errs := make([]error, len(sizes))
+	var wg sync.WaitGroup
+	wg.Add(len(sizes))
+	for i, size := range sizes {
+		go func(i, size int) {
+			defer wg.Done()
+			_, errs[i] = img.CenteredVersion(size, size, false)
+		}(i, size)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("size %d: %v", sizes[i], err)
+		}
+	}
+	if len(img.Versions) != len(sizes)+1 {
+		t.Errorf("expected %d versions (original + one per size), got %d", len(sizes)+1, len(img.Versions))
+	}
+}
+
+// TestLoadOriginalImageDistinctImagesSameFilenameAndSize guards against the
+// decodedOriginals cache collapsing two different Images that happen to
+// share a filename and original dimensions but not content - e.g. two
+// uploads both named "photo.jpg" from the same camera - into one cache
+// entry, which would make one Image's derived versions silently contain
+// the other's pixels.
+func TestLoadOriginalImageDistinctImagesSameFilenameAndSize(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	imgA, err := NewImage("photo.jpg", testPNGWithSeed(400, 300, 10))
+	if err != nil {
+		t.Fatalf("NewImage A: %v", err)
+	}
+	imgB, err := NewImage("photo.jpg", testPNGWithSeed(400, 300, 200))
+	if err != nil {
+		t.Fatalf("NewImage B: %v", err)
+	}
+
+	var vA, vB *ImageVersion
+	var errA, errB error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		vA, errA = imgA.CenteredVersion(50, 50, false)
+	}()
+	go func() {
+		defer wg.Done()
+		vB, errB = imgB.CenteredVersion(50, 50, false)
+	}()
+	wg.Wait()
+
+	if errA != nil {
+		t.Fatalf("imgA.CenteredVersion: %v", errA)
+	}
+	if errB != nil {
+		t.Fatalf("imgB.CenteredVersion: %v", errB)
+	}
+
+	dataA, err := backend.LoadImageVersionData(vA)
+	if err != nil {
+		t.Fatalf("LoadImageVersionData A: %v", err)
+	}
+	dataB, err := backend.LoadImageVersionData(vB)
+	if err != nil {
+		t.Fatalf("LoadImageVersionData B: %v", err)
+	}
+
+	decodedA, _, err := image.Decode(bytes.NewReader(dataA))
+	if err != nil {
+		t.Fatalf("decode A: %v", err)
+	}
+	decodedB, _, err := image.Decode(bytes.NewReader(dataB))
+	if err != nil {
+		t.Fatalf("decode B: %v", err)
+	}
+
+	center := decodedA.Bounds().Min.Add(decodedA.Bounds().Size().Div(2))
+	_, _, bA, _ := decodedA.At(center.X, center.Y).RGBA()
+	_, _, bB, _ := decodedB.At(center.X, center.Y).RGBA()
+
+	if uint8(bA>>8) != 10 {
+		t.Errorf("imgA's version has blue=%d, want seed 10 - got imgB's cached original instead", uint8(bA>>8))
+	}
+	if uint8(bB>>8) != 200 {
+		t.Errorf("imgB's version has blue=%d, want seed 200 - got imgA's cached original instead", uint8(bB>>8))
+	}
+}
+
+// TestVersionTouchOrigFromOutsideReusesCache checks that repeated,
+// sequential requests for the same outsideColor hit matchVersion instead
+// of regenerating: a stored version that never records OutsideColor would
+// never compare equal to a non-zero requested color, growing Versions and
+// re-saving to the backend on every call.
+func TestVersionTouchOrigFromOutsideReusesCache(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	img, err := NewImage("test.png", testPNG(400, 100))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	outsideColor := color.RGBA{R: 255, A: 255}
+	first, err := img.CenteredVersionTouchOrigFromOutside(200, 200, false, outsideColor)
+	if err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	second, err := img.CenteredVersionTouchOrigFromOutside(200, 200, false, outsideColor)
+	if err != nil {
+		t.Fatalf("second call: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("second call with the same outsideColor produced a new *ImageVersion instead of reusing the cached one")
+	}
+	if len(img.Versions) != 2 {
+		t.Errorf("expected 2 versions (original + one derived), got %d", len(img.Versions))
+	}
+}
@@ -0,0 +1,132 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/ungerik/go-start/model"
+)
+
+// ImageVersion is a resized, cropped and/or filtered rendition of an
+// Image's original. The original itself is stored as the first
+// ImageVersion of Image.Versions.
+type ImageVersion struct {
+	Filename     model.String `bson:",omitempty"`
+	ContentType  model.String
+	SourceRect   model.Rect
+	Width        model.Int
+	Height       model.Int
+	Grayscale    model.Bool
+	OutsideColor model.Color `bson:",omitempty"`
+	Filters      model.String `bson:",omitempty"`
+	ByteSize     model.Int
+
+	// DominantColorHexes holds up to 5 dominant colors of this version as
+	// comma separated "#rrggbb" strings, see DominantColors.
+	DominantColorHexes model.String `bson:",omitempty"`
+
+	// BlurHashValue holds the BlurHash string of this version, see BlurHash.
+	BlurHashValue model.String `bson:",omitempty"`
+
+	image *Image
+}
+
+func newImageVersion(filename, contentType string, sourceRect image.Rectangle, width, height int, grayscale bool) ImageVersion {
+	var v ImageVersion
+	v.Filename.Set(filename)
+	v.ContentType.Set(contentType)
+	v.SourceRect.SetRectangle(sourceRect)
+	v.Width.SetInt(width)
+	v.Height.SetInt(height)
+	v.Grayscale.Set(grayscale)
+	return v
+}
+
+// AspectRatio returns Width / Height
+func (self *ImageVersion) AspectRatio() float64 {
+	return float64(self.Width.GetInt()) / float64(self.Height.GetInt())
+}
+
+// DominantColors returns up to 5 dominant colors computed for this
+// version, ordered by frequency, for rendering a colored placeholder
+// before the real image loads.
+func (self *ImageVersion) DominantColors() []color.Color {
+	return parseHexColors(self.DominantColorHexes.Get())
+}
+
+// BlurHash returns the BlurHash string computed for this version,
+// suitable for a CSS/<img> blur-up placeholder while the real image loads.
+func (self *ImageVersion) BlurHash() string {
+	return self.BlurHashValue.Get()
+}
+
+// computePlaceholderMetadata computes and stores DominantColorHexes and
+// BlurHashValue for img. Both are computed from a small downscaled copy,
+// since neither needs full resolution and img can be as large as the
+// original.
+func (self *ImageVersion) computePlaceholderMetadata(img image.Image) {
+	hexes, blurHash := computePlaceholderStrings(img)
+	self.DominantColorHexes.Set(hexes)
+	self.BlurHashValue.Set(blurHash)
+}
+
+// SaveImageData persists the already encoded bytes of this version.
+func (self *ImageVersion) SaveImageData(data []byte) error {
+	return Config.Backend.SaveImageVersionData(self, data)
+}
+
+// LoadImageData returns the encoded bytes of this version.
+func (self *ImageVersion) LoadImageData() ([]byte, error) {
+	return Config.Backend.LoadImageVersionData(self)
+}
+
+// LoadImage decodes and returns the pixel data of this version. Formats
+// registered via RegisterCodec take precedence over the standard
+// library's image.Decode dispatch.
+func (self *ImageVersion) LoadImage() (image.Image, error) {
+	data, err := self.LoadImageData()
+	if err != nil {
+		return nil, err
+	}
+	if dec, ok := decoderFor(self.ContentType.Get()); ok {
+		return dec(bytes.NewReader(data))
+	}
+	i, _, err := image.Decode(bytes.NewReader(data))
+	return i, err
+}
+
+// SaveImage encodes im according to ContentType and persists the result.
+func (self *ImageVersion) SaveImage(im image.Image) error {
+	data, err := encodeImage(self.ContentType.Get(), im)
+	if err != nil {
+		return err
+	}
+	self.ByteSize.SetInt(len(data))
+	return self.SaveImageData(data)
+}
+
+// encodeImage encodes im as contentType and returns the resulting bytes.
+// Formats registered via RegisterCodec take precedence over the built-in
+// JPEG and PNG encoders, each using its own Config.FormatQuality setting.
+func encodeImage(contentType string, im image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if enc, ok := encoderFor(contentType); ok {
+		err = enc(&buf, im, qualityFor(contentType))
+	} else {
+		switch contentType {
+		case "image/jpeg":
+			err = jpeg.Encode(&buf, im, &jpeg.Options{Quality: Config.JPEGQuality})
+		default:
+			encoder := png.Encoder{CompressionLevel: Config.PNGCompressionLevel}
+			err = encoder.Encode(&buf, im)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package media
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// DefaultOriginalCacheMaxBytes is used when Config.OriginalCacheMaxBytes
+// is left at its zero value.
+const DefaultOriginalCacheMaxBytes = 64 * 1024 * 1024
+
+type originalCacheEntry struct {
+	key   string
+	image image.Image
+	bytes int
+}
+
+// originalImageCache is a bounded, concurrency-safe LRU of recently
+// decoded Image originals, keyed by a caller supplied identity string.
+// It is bounded by Config.OriginalCacheMaxBytes rather than entry count,
+// since originals vary wildly in decoded size. The most recently put
+// entry is never evicted, so a single original larger than the bound is
+// still cached.
+type originalImageCache struct {
+	mu       sync.Mutex
+	curBytes int
+	list     *list.List
+	entries  map[string]*list.Element
+}
+
+func newOriginalImageCache() *originalImageCache {
+	return &originalImageCache{
+		list:    list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (self *originalImageCache) get(key string) (image.Image, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	e, ok := self.entries[key]
+	if !ok {
+		return nil, false
+	}
+	self.list.MoveToFront(e)
+	return e.Value.(*originalCacheEntry).image, true
+}
+
+func (self *originalImageCache) put(key string, img image.Image, size int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if e, ok := self.entries[key]; ok {
+		self.list.MoveToFront(e)
+		entry := e.Value.(*originalCacheEntry)
+		self.curBytes += size - entry.bytes
+		entry.image = img
+		entry.bytes = size
+	} else {
+		entry := &originalCacheEntry{key: key, image: img, bytes: size}
+		self.entries[key] = self.list.PushFront(entry)
+		self.curBytes += size
+	}
+
+	maxBytes := Config.OriginalCacheMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultOriginalCacheMaxBytes
+	}
+	for self.curBytes > maxBytes && self.list.Len() > 1 {
+		back := self.list.Back()
+		entry := back.Value.(*originalCacheEntry)
+		self.list.Remove(back)
+		delete(self.entries, entry.key)
+		self.curBytes -= entry.bytes
+	}
+}
+
+// decodedOriginals is the package-wide cache used by Image.loadOriginalImage.
+var decodedOriginals = newOriginalImageCache()
@@ -0,0 +1,116 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	blurhash "github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+	colorextractor "github.com/marekm4/color-extractor"
+)
+
+// blurHashComponentsX/Y are the number of DCT components BlurHash encodes
+// along each axis; 4x3 is Wolt's recommended default and yields a ~20-30
+// character hash.
+const (
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+)
+
+// maxDominantColors bounds how many dominant colors are kept per version.
+const maxDominantColors = 5
+
+// placeholderDownsampleSize is the long-side dimension img is scaled to
+// before dominant-color extraction and BlurHash encoding, since both are
+// insensitive to resolution but not to the O(pixels) cost of running on
+// a full-size original.
+const placeholderDownsampleSize = 64
+
+// placeholderSourceImage returns a copy of img downscaled to at most
+// placeholderDownsampleSize on its long side, or img itself if it is
+// already smaller.
+func placeholderSourceImage(img image.Image) image.Image {
+	b := img.Bounds()
+	longSide := b.Dx()
+	if b.Dy() > longSide {
+		longSide = b.Dy()
+	}
+	if longSide <= placeholderDownsampleSize {
+		return img
+	}
+	scale := float64(placeholderDownsampleSize) / float64(longSide)
+	return imaging.Resize(img, int(float64(b.Dx())*scale), int(float64(b.Dy())*scale), imaging.Box)
+}
+
+// computePlaceholderStrings is the pure core of
+// ImageVersion.computePlaceholderMetadata: it touches only img, never an
+// ImageVersion or Image, so callers can run it before taking any lock
+// that guards shared state.
+func computePlaceholderStrings(img image.Image) (hexes, blurHash string) {
+	small := placeholderSourceImage(img)
+	return computeDominantColorHexes(small), computeBlurHash(small)
+}
+
+// computeDominantColorHexes extracts up to maxDominantColors dominant
+// colors from img and returns them as a comma separated list of
+// "#rrggbb" strings, suitable for storing in ImageVersion.DominantColorHexes.
+func computeDominantColorHexes(img image.Image) string {
+	colors := colorextractor.ExtractColors(img)
+	if len(colors) > maxDominantColors {
+		colors = colors[:maxDominantColors]
+	}
+	hexes := make([]string, len(colors))
+	for i, c := range colors {
+		hexes[i] = colorToHex(c)
+	}
+	return strings.Join(hexes, ",")
+}
+
+// computeBlurHash returns the BlurHash of img, or "" if it could not be
+// computed (e.g. a zero sized image).
+func computeBlurHash(img image.Image) string {
+	hash, err := blurhash.Encode(blurHashComponentsX, blurHashComponentsY, img)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+func colorToHex(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", uint8(r>>8), uint8(g>>8), uint8(b>>8))
+}
+
+func parseHexColors(s string) []color.Color {
+	if s == "" {
+		return nil
+	}
+	hexes := strings.Split(s, ",")
+	colors := make([]color.Color, 0, len(hexes))
+	for _, hex := range hexes {
+		if c, ok := hexToColor(hex); ok {
+			colors = append(colors, c)
+		}
+	}
+	return colors
+}
+
+func hexToColor(hex string) (color.Color, bool) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return nil, false
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	return color.RGBA{
+		R: uint8(v >> 16),
+		G: uint8(v >> 8),
+		B: uint8(v),
+		A: 255,
+	}, true
+}
@@ -0,0 +1,50 @@
+package media
+
+import "testing"
+
+// TestNewImageComputesPlaceholderMetadata checks that NewImage populates
+// both DominantColors and BlurHash for the original version, so templates
+// can render a placeholder before the real image loads.
+func TestNewImageComputesPlaceholderMetadata(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	img, err := NewImage("test.png", testPNGWithSeed(40, 40, 200))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	colors := img.DominantColors()
+	if len(colors) == 0 {
+		t.Errorf("DominantColors() returned no colors for the original version")
+	}
+
+	hash := img.Versions[0].BlurHash()
+	if hash == "" {
+		t.Errorf("BlurHash() returned empty string for the original version")
+	}
+}
+
+// TestSourceRectVersionComputesPlaceholderMetadata checks that a derived
+// version gets its own placeholder metadata, not just the original.
+func TestSourceRectVersionComputesPlaceholderMetadata(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	img, err := NewImage("test.png", testPNGWithSeed(200, 200, 50))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	version, err := img.CenteredVersion(40, 40, false)
+	if err != nil {
+		t.Fatalf("CenteredVersion: %v", err)
+	}
+
+	if version.BlurHash() == "" {
+		t.Errorf("derived version's BlurHash() is empty")
+	}
+	if len(version.DominantColors()) == 0 {
+		t.Errorf("derived version's DominantColors() is empty")
+	}
+}
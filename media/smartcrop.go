@@ -0,0 +1,138 @@
+package media
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropDownsampleSize is the long-side dimension an original is
+// scaled to before its edge energy is computed, similar to Hugo's
+// smartcrop port.
+const smartCropDownsampleSize = 200
+
+// smartCropEnergyMap holds the per-pixel edge energy of a downsampled
+// copy of an Image's original, plus the scale factor back to the
+// original's full resolution.
+type smartCropEnergyMap struct {
+	energy []float64
+	width  int
+	height int
+	scaleX float64
+	scaleY float64
+}
+
+func newSmartCropEnergyMap(orig image.Image) *smartCropEnergyMap {
+	b := orig.Bounds()
+	longSide := b.Dx()
+	if b.Dy() > longSide {
+		longSide = b.Dy()
+	}
+	scale := 1.0
+	if longSide > smartCropDownsampleSize {
+		scale = float64(smartCropDownsampleSize) / float64(longSide)
+	}
+	small := orig
+	if scale < 1 {
+		small = imaging.Resize(orig, int(float64(b.Dx())*scale), int(float64(b.Dy())*scale), imaging.Box)
+	}
+	gray := imaging.Grayscale(small)
+	sb := gray.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+
+	luminance := func(x, y int) float64 {
+		if x < sb.Min.X {
+			x = sb.Min.X
+		} else if x >= sb.Max.X {
+			x = sb.Max.X - 1
+		}
+		if y < sb.Min.Y {
+			y = sb.Min.Y
+		} else if y >= sb.Max.Y {
+			y = sb.Max.Y - 1
+		}
+		r, _, _, _ := gray.At(x, y).RGBA()
+		return float64(r)
+	}
+
+	energy := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx := luminance(sb.Min.X+x+1, sb.Min.Y+y) - luminance(sb.Min.X+x-1, sb.Min.Y+y)
+			dy := luminance(sb.Min.X+x, sb.Min.Y+y+1) - luminance(sb.Min.X+x, sb.Min.Y+y-1)
+			energy[y*w+x] = math.Abs(dx) + math.Abs(dy)
+		}
+	}
+
+	return &smartCropEnergyMap{
+		energy: energy,
+		width:  w,
+		height: h,
+		scaleX: float64(b.Dx()) / float64(w),
+		scaleY: float64(b.Dy()) / float64(h),
+	}
+}
+
+// bestWindow slides a window of the given aspect ratio across the energy
+// map and returns the original-image coordinates of the window that
+// maximizes contained edge energy, weighted by a 2D Gaussian centered on
+// bias (in original image coordinates).
+func (self *smartCropEnergyMap) bestWindow(aspectRatio float64, bias image.Point) image.Rectangle {
+	winWidth := self.width
+	winHeight := int(float64(self.width) / aspectRatio)
+	if winHeight > self.height {
+		winHeight = self.height
+		winWidth = int(float64(self.height) * aspectRatio)
+	}
+	if winWidth < 1 {
+		winWidth = 1
+	}
+	if winHeight < 1 {
+		winHeight = 1
+	}
+
+	centerX := float64(bias.X) / self.scaleX
+	centerY := float64(bias.Y) / self.scaleY
+	sigma := float64(self.width+self.height) / 4
+
+	step := 1
+	if self.width*self.height > 10000 {
+		step = 2 // keep the search cheap on larger downsampled maps
+	}
+
+	bestScore := math.Inf(-1)
+	var best image.Rectangle
+	for y := 0; y <= self.height-winHeight; y += step {
+		for x := 0; x <= self.width-winWidth; x += step {
+			score := self.windowEnergy(x, y, winWidth, winHeight)
+			wx := float64(x) + float64(winWidth)/2
+			wy := float64(y) + float64(winHeight)/2
+			dx := wx - centerX
+			dy := wy - centerY
+			score *= math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+			if score > bestScore {
+				bestScore = score
+				best = image.Rect(x, y, x+winWidth, y+winHeight)
+			}
+		}
+	}
+
+	return image.Rect(
+		int(float64(best.Min.X)*self.scaleX),
+		int(float64(best.Min.Y)*self.scaleY),
+		int(float64(best.Max.X)*self.scaleX),
+		int(float64(best.Max.Y)*self.scaleY),
+	)
+}
+
+func (self *smartCropEnergyMap) windowEnergy(x, y, w, h int) float64 {
+	sum := 0.0
+	for j := y; j < y+h; j++ {
+		row := j * self.width
+		for i := x; i < x+w; i++ {
+			sum += self.energy[row+i]
+		}
+	}
+	return sum
+}
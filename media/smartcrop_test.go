@@ -0,0 +1,60 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// busySideTestPNG returns a width x height image that is flat (zero edge
+// energy) everywhere except its rightmost quarter, which is a
+// high-frequency checkerboard, so a smart crop window should be pulled
+// toward that quarter rather than staying centered.
+func busySideTestPNG(width, height int) []byte {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	busyFrom := width - width/4
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < busyFrom {
+				img.SetGray(x, y, color.Gray{Y: 128})
+			} else if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 0})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// TestSmartVersionBiasesTowardEnergy checks that SmartVersion picks a
+// source rectangle favoring the higher edge-energy half of the image
+// rather than e.g. always centering the window.
+func TestSmartVersionBiasesTowardEnergy(t *testing.T) {
+	backend := newMemoryBackend()
+	Config.Backend = backend
+
+	const width, height = 200, 100
+	img, err := NewImage("test.png", busySideTestPNG(width, height))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	version, err := img.SmartVersion(50, 100, false)
+	if err != nil {
+		t.Fatalf("SmartVersion: %v", err)
+	}
+
+	sourceRect := version.SourceRect.Rectangle()
+	center := (sourceRect.Min.X + sourceRect.Max.X) / 2
+	// A window ignoring content energy would stay near the image center
+	// (x=100); the busy quarter starts at x=150, so a meaningfully
+	// content-biased window should land past the midpoint.
+	if center <= width/2 {
+		t.Errorf("SmartVersion picked window %v centered at x=%d, want it biased toward the busy quarter starting at x=%d", sourceRect, center, width-width/4)
+	}
+}
@@ -0,0 +1,21 @@
+package media
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+	xwebp "golang.org/x/image/webp"
+)
+
+func init() {
+	RegisterCodec("image/webp", decodeWebP, encodeWebP)
+}
+
+func decodeWebP(r io.Reader) (image.Image, error) {
+	return xwebp.Decode(r)
+}
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Lossless: false, Quality: float32(quality)})
+}